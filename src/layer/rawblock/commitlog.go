@@ -3,7 +3,9 @@ package rawblock
 import (
 	"errors"
 	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
@@ -15,10 +17,23 @@ const (
 	defaultBatchSize       = 4096
 	defaultMaxPendingBytes = 10000000
 	defaultFlushEvery      = time.Millisecond
+	defaultMaxQueueWait    = 5 * time.Second
+	defaultNumShards       = 1
 
 	commitLogKey = "commitlog-"
 )
 
+// ErrCommitlogBackpressureTimeout is returned by Write/WriteNoSyncWait when
+// the pending batch stays too full to admit the record within
+// CommitlogOptions.MaxPendingBytes for longer than
+// CommitlogOptions.MaxQueueWait.
+var ErrCommitlogBackpressureTimeout = errors.New("commitlog: timed out waiting for queue to drain")
+
+// ErrCommitlogRecordTooLarge is returned by Write/WriteNoSyncWait when a
+// single record is larger than CommitlogOptions.MaxPendingBytes, since no
+// amount of waiting for the queue to drain would ever admit it.
+var ErrCommitlogRecordTooLarge = errors.New("commitlog: record larger than MaxPendingBytes")
+
 type clStatus int
 
 const (
@@ -27,22 +42,109 @@ const (
 	clStatusClosed
 )
 
-// truncationToken is a token that can be passed to the commitlog to truncate the commitlogs up to
-// a specific point. It should be treated as opaque by external callers.
-type truncationToken struct {
-	upTo tuple.Tuple
-}
-
 type Commitlog interface {
-	Write([]byte) error
+	// Write appends b to the commitlog, routed to a shard by hash of
+	// routingKey, and blocks until it has been durably flushed. seq is a
+	// monotonically increasing sequence/timestamp for b that the shard
+	// uses to keep its flushed batches in order even if writes for it
+	// arrive out of order.
+	Write(routingKey []byte, seq int64, b []byte) error
+	// WriteNoSyncWait appends b to the commitlog, routed to a shard by
+	// hash of routingKey, and returns as soon as it has been assigned a
+	// place in that shard's pending batch, without waiting for that batch
+	// to actually be flushed. Callers that need to know once b is durable
+	// should call SyncWait() on the returned handle.
+	WriteNoSyncWait(routingKey []byte, seq int64, b []byte) (SyncHandle, error)
 	Open() error
 	Close() error
+	// Metrics returns a snapshot of the commitlog's queue metrics, useful
+	// for tuning IdealBatchSize and FlushEvery.
+	Metrics() CommitlogMetrics
+	// RegisterListener registers fn to be called with every write, flush,
+	// and active-log-rotation event going forward. fn is called
+	// synchronously from whichever goroutine produced the event, so it
+	// must not block or call back into the Commitlog.
+	RegisterListener(fn func(CallbackResult))
+	// Truncate truncates every shard's commitlog up to the point recorded
+	// in token for that shard.
+	Truncate(token TruncationToken) error
+}
+
+// EventType identifies the kind of event a CallbackResult describes.
+type EventType int
+
+const (
+	// WriteEvent fires once a record has been appended to the pending
+	// batch and assigned its place in it.
+	WriteEvent EventType = iota
+	// FlushEvent fires once a batch has been committed to FDB (or failed
+	// to commit).
+	FlushEvent
+	// ActiveLogsEvent fires whenever a flush rotates onto one or more new
+	// active commitlog keys.
+	ActiveLogsEvent
+)
+
+// ActiveLogsResult describes the commitlog keys that became active as part
+// of the flush a CallbackResult is reporting on.
+type ActiveLogsResult struct {
+	ActiveKeys []tuple.Tuple
+}
+
+// CallbackResult is the payload delivered to listeners registered via
+// Commitlog.RegisterListener.
+type CallbackResult struct {
+	EventType EventType
+	Err       error
+	// ShardID identifies which shard produced this event. A caller watching
+	// ActiveLogsEvent on a sharded Commitlog needs it to know which slot of
+	// a TruncationToken an ActiveLogsResult's keys belong to.
+	ShardID    int
+	ActiveLogs ActiveLogsResult
+}
+
+// CommitlogMetrics is a snapshot of the commitlog's pending-queue state.
+type CommitlogMetrics struct {
+	// QueueDepthBytes is the size, in bytes, of the batch currently
+	// pending flush.
+	QueueDepthBytes int
+	// QueueWaitTime is the cumulative time Write/WriteNoSyncWait callers
+	// have spent blocked on backpressure.
+	QueueWaitTime time.Duration
+}
+
+// SyncHandle is returned by Commitlog.WriteNoSyncWait and lets the caller
+// block until the record it was issued for has been durably flushed,
+// without forcing the call to Write itself to block.
+type SyncHandle interface {
+	// SeqNum returns the caller-supplied seq the record this handle was
+	// issued for was written with (the same value passed into
+	// Write/WriteNoSyncWait), published immediately rather than requiring a
+	// SyncWait. It is not a commitlog-assigned key or offset — ordering
+	// within a shard is still derived from this value, not the other way
+	// around — it just saves a pipelining caller from having to hold onto
+	// its own copy of seq alongside the handle.
+	SeqNum() int64
+	// SyncWait blocks until the record this handle was issued for has been
+	// durably flushed, and returns the error (if any) from that flush.
+	SyncWait() error
 }
 
 type CommitlogOptions struct {
 	IdealBatchSize  int
 	MaxPendingBytes int
 	FlushEvery      time.Duration
+	// MaxQueueWait bounds how long Write/WriteNoSyncWait will block on
+	// backpressure while the pending batch is too full to admit the record
+	// within MaxPendingBytes before giving up with
+	// ErrCommitlogBackpressureTimeout.
+	MaxQueueWait time.Duration
+	// NumShards is the number of independent commitlog writers to shard
+	// writes across. Defaults to 1.
+	NumShards int
+	// HostID identifies this process in the commitlog keyspace so that
+	// multiple hosts sharing an FDB cluster never collide on the same key.
+	HostID string
 }
 
 func NewCommitlogOptions() CommitlogOptions {
@@ -50,18 +152,38 @@ func NewCommitlogOptions() CommitlogOptions {
 		IdealBatchSize:  defaultBatchSize,
 		MaxPendingBytes: defaultMaxPendingBytes,
 		FlushEvery:      defaultFlushEvery,
+		MaxQueueWait:    defaultMaxQueueWait,
+		NumShards:       defaultNumShards,
 	}
 }
 
+// flushOutcome tracks a single pending batch through its two signaled
+// stages: markEnqueued fires for each record as soon as it is appended to
+// the batch (so a WriteEvent listener can act on the write before it's
+// durable), and doneCh
+// closes once the batch's FDB transaction has actually committed.
 type flushOutcome struct {
-	lastID tuple.Tuple
-	err    error
-	doneCh chan struct{}
+	lastID   tuple.Tuple
+	err      error
+	enqueued bool
+	doneCh   chan struct{}
+	dispatch func(CallbackResult)
 }
 
-func newFlushOutcome() *flushOutcome {
+func newFlushOutcome(dispatch func(CallbackResult)) *flushOutcome {
 	return &flushOutcome{
-		doneCh: make(chan struct{}, 0),
+		doneCh:   make(chan struct{}, 0),
+		dispatch: dispatch,
+	}
+}
+
+// markEnqueued dispatches the WriteEvent for a record just appended to this
+// flushOutcome's batch. It must be called with the commitlog's lock held, so
+// that concurrent appends to the same batch dispatch in append order.
+func (f *flushOutcome) markEnqueued() {
+	f.enqueued = true
+	if f.dispatch != nil {
+		f.dispatch(CallbackResult{EventType: WriteEvent})
 	}
 }
 
@@ -70,33 +192,114 @@ func (f *flushOutcome) waitForFlush() error {
 	return f.err
 }
 
-func (f *flushOutcome) notify(lastID tuple.Tuple, err error) {
+// notify records the outcome of the flush this flushOutcome was tracking,
+// unblocks anyone waiting on it, and is the single producer of the
+// FlushEvent/ActiveLogsEvent callbacks for that flush.
+func (f *flushOutcome) notify(lastID tuple.Tuple, activeLogs ActiveLogsResult, err error) {
 	f.lastID = lastID
 	f.err = err
 	close(f.doneCh)
+
+	if f.dispatch == nil {
+		return
+	}
+	f.dispatch(CallbackResult{EventType: FlushEvent, Err: err})
+	if err == nil && len(activeLogs.ActiveKeys) > 0 {
+		f.dispatch(CallbackResult{EventType: ActiveLogsEvent, ActiveLogs: activeLogs})
+	}
+}
+
+// syncHandle is the concrete SyncHandle returned by WriteNoSyncWait. Besides
+// the seqnum it was issued with, it is just a reference to the flushOutcome
+// of the batch the record was appended to, since that's exactly what closes
+// once the record becomes durable.
+type syncHandle struct {
+	seq     int64
+	outcome *flushOutcome
+}
+
+func (h *syncHandle) SeqNum() int64 {
+	return h.seq
+}
+
+func (h *syncHandle) SyncWait() error {
+	return h.outcome.waitForFlush()
 }
 
 type commitlog struct {
 	sync.Mutex
-	status        clStatus
-	db            fdb.Database
-	prevBatch     []byte
-	currBatch     []byte
-	lastFlushTime time.Time
-	flushOutcome  *flushOutcome
-	closeCh       chan struct{}
-	closeDoneCh   chan error
-	opts          CommitlogOptions
+	status         clStatus
+	db             fdb.Database
+	hostID         string
+	shardID        int
+	seq            int64
+	prevBatch      []bufferedRecord
+	currBatch      []bufferedRecord
+	secondaryBatch []bufferedRecord
+	maxWriteSeq    int64
+	// currBatchSize is the total pending bytes across currBatch and
+	// secondaryBatch combined (what backpressure is measured against);
+	// secondaryBatchSize is just the secondaryBatch slice of that total, so
+	// flush() can re-derive currBatchSize after swapping currBatch out
+	// without losing track of bytes still parked in secondaryBatch.
+	currBatchSize      int
+	secondaryBatchSize int
+	drainCh            chan struct{}
+	lastFlushTime      time.Time
+	flushOutcome       *flushOutcome
+	closeCh            chan struct{}
+	closeDoneCh        chan error
+	opts               CommitlogOptions
+
+	queueDepthBytes    int64
+	queueWaitTimeNanos int64
+
+	listenersMu sync.Mutex
+	listeners   []func(CallbackResult)
 }
 
-func NewCommitlog(db fdb.Database, opts CommitlogOptions) Commitlog {
-	return &commitlog{
-		status:       clStatusUnopened,
-		db:           db,
-		flushOutcome: newFlushOutcome(),
-		closeCh:      make(chan struct{}, 1),
-		closeDoneCh:  make(chan error, 1),
-		opts:         opts,
+// bufferedRecord is a framed record waiting in a shard's in-memory buffers
+// to be flushed, tagged with the caller-supplied write sequence it needs to
+// be ordered by.
+type bufferedRecord struct {
+	seq    int64
+	record []byte
+}
+
+// newCommitlogShard constructs a single shard of a Commitlog. hostID and
+// shardID together identify this shard's slice of the commitlog keyspace.
+func newCommitlogShard(db fdb.Database, opts CommitlogOptions, hostID string, shardID int) *commitlog {
+	c := &commitlog{
+		status:      clStatusUnopened,
+		db:          db,
+		hostID:      hostID,
+		shardID:     shardID,
+		drainCh:     make(chan struct{}),
+		closeCh:     make(chan struct{}, 1),
+		closeDoneCh: make(chan error, 1),
+		opts:        opts,
+	}
+	c.flushOutcome = newFlushOutcome(c.dispatch)
+	return c
+}
+
+// RegisterListener registers fn to receive every subsequent write, flush,
+// and active-log-rotation event.
+func (c *commitlog) RegisterListener(fn func(CallbackResult)) {
+	c.listenersMu.Lock()
+	c.listeners = append(c.listeners, fn)
+	c.listenersMu.Unlock()
+}
+
+func (c *commitlog) dispatch(result CallbackResult) {
+	result.ShardID = c.shardID
+
+	c.listenersMu.Lock()
+	listeners := c.listeners
+	c.listenersMu.Unlock()
+
+	for _, fn := range listeners {
+		fn(result)
 	}
 }
 
@@ -110,8 +313,8 @@ func (c *commitlog) Open() error {
 	c.Unlock()
 
 	go func() {
+		i := 0
 		for {
-			i := 0
 			select {
 			case <-c.closeCh:
 				c.closeDoneCh <- c.flush()
@@ -120,11 +323,7 @@ func (c *commitlog) Open() error {
 			}
 			time.Sleep(time.Millisecond)
 			if i%10 == 0 {
-				// TODO(rartoul): Remove this.
-				// Truncate regularly to measure performance impact.
-				if err := c.Truncate(); err != nil {
-					log.Printf("error truncating commitlog: %v", err)
-				}
+				c.mergeSecondary()
 			}
 			if err := c.flush(); err != nil {
 				log.Printf("error flushing commitlog: %v", err)
@@ -151,31 +350,156 @@ func (c *commitlog) Close() error {
 
 // TODO(rartoul): Kind of gross that this just takes a []byte but more
 // flexible for now.
-func (c *commitlog) Write(b []byte) error {
+//
+// seq is a monotonically increasing sequence/timestamp for b, used to keep
+// the batch actually written to FDB in order even when writes for a shard
+// arrive out of order.
+func (c *commitlog) Write(seq int64, b []byte) error {
+	handle, err := c.WriteNoSyncWait(seq, b)
+	if err != nil {
+		return err
+	}
+	return handle.SyncWait()
+}
+
+func (c *commitlog) WriteNoSyncWait(seq int64, b []byte) (SyncHandle, error) {
 	if len(b) == 0 {
-		return errors.New("commit log can not write empty chunk")
+		return nil, errors.New("commit log can not write empty chunk")
 	}
 
-	c.Lock()
-	if c.status != clStatusOpen {
-		c.Unlock()
-		return errors.New("cannot write into commit log that is not open")
+	record := encodeRecord(b)
+	if len(record) > c.opts.MaxPendingBytes {
+		// Even an otherwise-empty batch could never admit this record, so
+		// waiting out the full MaxQueueWait would just be a slow way to
+		// fail; reject it immediately with a distinct error instead.
+		return nil, ErrCommitlogRecordTooLarge
 	}
 
-	if len(c.currBatch)+len(b) > c.opts.MaxPendingBytes {
+	var (
+		waitStart time.Time
+		deadline  time.Time
+	)
+	for {
+		c.Lock()
+		if c.status != clStatusOpen {
+			c.Unlock()
+			return nil, errors.New("cannot write into commit log that is not open")
+		}
+
+		if c.currBatchSize+len(record) <= c.opts.MaxPendingBytes {
+			break
+		}
+
+		drainCh := c.drainCh
 		c.Unlock()
-		return errors.New("commit log queue is full")
+
+		if waitStart.IsZero() {
+			waitStart = time.Now()
+			deadline = waitStart.Add(c.opts.MaxQueueWait)
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			atomic.AddInt64(&c.queueWaitTimeNanos, int64(time.Since(waitStart)))
+			return nil, ErrCommitlogBackpressureTimeout
+		}
+
+		select {
+		case <-drainCh:
+		case <-time.After(remaining):
+			atomic.AddInt64(&c.queueWaitTimeNanos, int64(time.Since(waitStart)))
+			return nil, ErrCommitlogBackpressureTimeout
+		}
+	}
+	if !waitStart.IsZero() {
+		atomic.AddInt64(&c.queueWaitTimeNanos, int64(time.Since(waitStart)))
 	}
 
-	c.currBatch = append(c.currBatch, b...)
+	buffered := bufferedRecord{seq: seq, record: record}
+	if len(c.currBatch) > 0 && seq < c.maxWriteSeq {
+		// Arrived out of order relative to the primary buffer's tail; park
+		// it in the secondary buffer for the background merge to fold back
+		// in before the next flush.
+		c.secondaryBatch = append(c.secondaryBatch, buffered)
+		c.secondaryBatchSize += len(record)
+	} else {
+		c.currBatch = append(c.currBatch, buffered)
+		c.maxWriteSeq = seq
+	}
+	c.currBatchSize += len(record)
+	atomic.StoreInt64(&c.queueDepthBytes, int64(c.currBatchSize))
 	currFlushOutcome := c.flushOutcome
+	// Signal the enqueued stage before releasing the lock, so that
+	// WriteEvents for records appended to the same batch dispatch in the
+	// same order they were appended.
+	currFlushOutcome.markEnqueued()
 	c.Unlock()
-	return currFlushOutcome.waitForFlush()
+
+	// The record has been appended and assigned its place in the pending
+	// batch as of this point, so the caller is free to pipeline more
+	// writes; the returned handle is how it finds out once this batch is
+	// actually durable.
+	return &syncHandle{seq: seq, outcome: currFlushOutcome}, nil
 }
 
-func (c *commitlog) Truncate(token truncationToken) error {
+// mergeSecondary folds any writes that arrived out of order back into the
+// primary buffer in sorted order, so that the next flush writes a
+// monotonic run to FDB. The loop started by Open runs it on every tenth
+// pass, as a backstop for whatever flush() doesn't already merge itself.
+func (c *commitlog) mergeSecondary() {
+	c.Lock()
+	defer c.Unlock()
+	c.mergeSecondaryLocked()
+}
+
+// mergeSecondaryLocked is the body of mergeSecondary, factored out so that
+// flush() can also call it while already holding the lock: flush() must
+// merge before it swaps currBatch out, or whatever's parked in
+// secondaryBatch (seq older than the primary tail) would get written to FDB
+// in a later block than the higher-seq records already flushed, breaking
+// the monotonic-run guarantee for any flush that beats the periodic merge.
+func (c *commitlog) mergeSecondaryLocked() {
+	if len(c.secondaryBatch) == 0 {
+		return
+	}
+
+	sort.Slice(c.secondaryBatch, func(i, j int) bool {
+		return c.secondaryBatch[i].seq < c.secondaryBatch[j].seq
+	})
+
+	merged := make([]bufferedRecord, 0, len(c.currBatch)+len(c.secondaryBatch))
+	i, j := 0, 0
+	for i < len(c.currBatch) && j < len(c.secondaryBatch) {
+		if c.currBatch[i].seq <= c.secondaryBatch[j].seq {
+			merged = append(merged, c.currBatch[i])
+			i++
+		} else {
+			merged = append(merged, c.secondaryBatch[j])
+			j++
+		}
+	}
+	merged = append(merged, c.currBatch[i:]...)
+	merged = append(merged, c.secondaryBatch[j:]...)
+
+	c.currBatch = merged
+	c.secondaryBatch = c.secondaryBatch[:0]
+	// The merged bytes are already counted in currBatchSize; only
+	// secondaryBatchSize's slice of that total needs clearing.
+	c.secondaryBatchSize = 0
+}
+
+// Metrics returns a snapshot of the commitlog's queue metrics.
+func (c *commitlog) Metrics() CommitlogMetrics {
+	return CommitlogMetrics{
+		QueueDepthBytes: int(atomic.LoadInt64(&c.queueDepthBytes)),
+		QueueWaitTime:   time.Duration(atomic.LoadInt64(&c.queueWaitTimeNanos)),
+	}
+}
+
+// truncateUpTo truncates this shard's commitlog up to (but not including)
+// upTo.
+func (c *commitlog) truncateUpTo(upTo tuple.Tuple) error {
 	_, err := c.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
-		tr.ClearRange(fdb.KeyRange{Begin: tuple.Tuple{commitLogKey}, End: token.upTo})
+		tr.ClearRange(fdb.KeyRange{Begin: tuple.Tuple{commitLogKey, c.hostID, c.shardID}, End: upTo})
 		return nil, nil
 	})
 
@@ -188,39 +512,72 @@ func (c *commitlog) flush() error {
 		c.Unlock()
 		return nil
 	}
+	// Fold in anything still parked in secondaryBatch before swapping
+	// currBatch out, so the block written below is always a monotonic run.
+	c.mergeSecondaryLocked()
 
 	toWrite := c.currBatch
 	c.currBatch, c.prevBatch = c.prevBatch, c.currBatch
 	c.currBatch = c.currBatch[:0]
+	// Only currBatch is being flushed; whatever is still parked in
+	// secondaryBatch remains pending, so currBatchSize must shrink back to
+	// secondaryBatchSize rather than 0.
+	c.currBatchSize = c.secondaryBatchSize
+	atomic.StoreInt64(&c.queueDepthBytes, int64(c.currBatchSize))
 	currFlushOutcome := c.flushOutcome
-	c.flushOutcome = newFlushOutcome()
+	c.flushOutcome = newFlushOutcome(c.dispatch)
+	drainedCh := c.drainCh
+	c.drainCh = make(chan struct{})
 	c.Unlock()
-
-	key, err := c.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
-		// TODO(rartoul): Need to be smarter about this because don't want to actually
-		// break chunks across writes I.E every call to WriteBatch() should end up
-		// in one key so that each key is a complete unit.
+	// Wake up any Write/WriteNoSyncWait callers blocked on backpressure now
+	// that the batch they were waiting behind has been drained.
+	close(drainedCh)
+
+	res, err := c.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+		// Pack whole records into physical blocks that map 1:1 to an FDB
+		// key/value. A record is never split across two blocks, so a block
+		// is either fully present or fully absent and truncation can always
+		// be expressed as "up to the last fully-durable record".
 		var (
-			startIdx = 0
-			key      tuple.Tuple
+			block      []byte
+			lastKey    tuple.Tuple
+			activeKeys []tuple.Tuple
 		)
-		for startIdx < len(toWrite) {
-			key := c.nextKey()
-			endIdx := startIdx + c.opts.IdealBatchSize
-			if endIdx > len(toWrite) {
-				endIdx = len(toWrite)
+		for _, buffered := range toWrite {
+			record := buffered.record
+			if len(block) > 0 && len(block)+len(record) > c.opts.IdealBatchSize {
+				lastKey = c.nextKey()
+				tr.Set(lastKey, block)
+				activeKeys = append(activeKeys, lastKey)
+				block = nil
 			}
-			tr.Set(key, toWrite[startIdx:endIdx])
-			startIdx = endIdx
+			block = append(block, record...)
+		}
+		if len(block) > 0 {
+			lastKey = c.nextKey()
+			tr.Set(lastKey, block)
+			activeKeys = append(activeKeys, lastKey)
 		}
 
-		return key, nil
+		return flushResult{lastKey: lastKey, activeKeys: activeKeys}, nil
 	})
-	currFlushOutcome.notify(key.(tuple.Tuple), err)
+	fr, _ := res.(flushResult)
+	currFlushOutcome.notify(fr.lastKey, ActiveLogsResult{ActiveKeys: fr.activeKeys}, err)
 	return err
 }
 
+// flushResult is the value returned out of the FDB transaction run by
+// flush(): the key of the last block written, and every key that was
+// written as part of rotating onto new active commitlog blocks.
+type flushResult struct {
+	lastKey    tuple.Tuple
+	activeKeys []tuple.Tuple
+}
+
+// nextKey returns the key for the next block this shard will flush. Only
+// called from within flush(), which never runs concurrently with itself for
+// a given shard, so c.seq needs no synchronization of its own.
 func (c *commitlog) nextKey() tuple.Tuple {
-	// TODO(rartoul): This should have some kind of host identifier in it.
-	return tuple.Tuple{commitLogKey, time.Now().UnixNano()}
+	c.seq++
+	return tuple.Tuple{commitLogKey, c.hostID, c.shardID, c.seq}
 }
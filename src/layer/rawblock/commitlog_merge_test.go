@@ -0,0 +1,77 @@
+package rawblock
+
+import (
+	"reflect"
+	"testing"
+)
+
+func seqsOf(records []bufferedRecord) []int64 {
+	out := make([]int64, len(records))
+	for i, r := range records {
+		out[i] = r.seq
+	}
+	return out
+}
+
+func TestMergeSecondaryOrdersIntoPrimary(t *testing.T) {
+	c := &commitlog{
+		currBatch: []bufferedRecord{
+			{seq: 1, record: []byte("a")},
+			{seq: 3, record: []byte("b")},
+			{seq: 5, record: []byte("c")},
+		},
+		secondaryBatch: []bufferedRecord{
+			{seq: 4, record: []byte("d")},
+			{seq: 2, record: []byte("e")},
+		},
+		// Bytes for all five one-byte records, already counted when each
+		// was appended by WriteNoSyncWait.
+		currBatchSize:      5,
+		secondaryBatchSize: 2,
+	}
+
+	c.mergeSecondary()
+
+	if got, want := seqsOf(c.currBatch), []int64{1, 2, 3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected merged seqs %v, got %v", want, got)
+	}
+	if len(c.secondaryBatch) != 0 {
+		t.Fatalf("expected secondaryBatch to be drained, got %v", c.secondaryBatch)
+	}
+	if c.secondaryBatchSize != 0 {
+		t.Fatalf("expected secondaryBatchSize reset to 0, got %d", c.secondaryBatchSize)
+	}
+	if c.currBatchSize != 5 {
+		t.Fatalf("expected currBatchSize unchanged by merge (bytes already counted), got %d", c.currBatchSize)
+	}
+}
+
+func TestMergeSecondaryNoOpWhenEmpty(t *testing.T) {
+	c := &commitlog{
+		currBatch: []bufferedRecord{{seq: 1, record: []byte("a")}},
+	}
+
+	c.mergeSecondary()
+
+	if got, want := seqsOf(c.currBatch), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected currBatch untouched, got %v", got)
+	}
+}
+
+func TestMergeSecondaryAllOlderThanPrimary(t *testing.T) {
+	c := &commitlog{
+		currBatch: []bufferedRecord{
+			{seq: 10, record: []byte("a")},
+		},
+		secondaryBatch: []bufferedRecord{
+			{seq: 2, record: []byte("b")},
+			{seq: 1, record: []byte("c")},
+		},
+	}
+
+	c.mergeSecondary()
+
+	if got, want := seqsOf(c.currBatch), []int64{1, 2, 10}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected merged seqs %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,94 @@
+package rawblock
+
+import (
+	"errors"
+	"io"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// CommitlogReader replays the records written to a Commitlog by scanning the
+// commitlog keyspace directly. Records come back in key order: grouped by
+// host id, then by shard id, and within a shard in the order that shard
+// flushed them; records of different shards are not interleaved by flush
+// time. It is used to recover (or otherwise replay) a commitlog into
+// the raw block store, for example after a crash.
+type CommitlogReader interface {
+	// Open loads the set of commitlog blocks that exist at the time of the
+	// call and positions the reader at the first record.
+	Open() error
+	// Next returns the next record written to the commitlog, or io.EOF once
+	// every record has been returned.
+	Next() ([]byte, error)
+	// Close closes the reader.
+	Close() error
+}
+
+type commitlogReader struct {
+	status  clStatus
+	db      fdb.Database
+	records [][]byte
+	idx     int
+}
+
+// NewCommitlogReader creates a new CommitlogReader that scans the commitlog
+// keyspace backing db.
+func NewCommitlogReader(db fdb.Database) CommitlogReader {
+	return &commitlogReader{
+		status: clStatusUnopened,
+		db:     db,
+	}
+}
+
+func (r *commitlogReader) Open() error {
+	if r.status != clStatusUnopened {
+		return errors.New("commitlog reader cannot be opened more than once")
+	}
+	r.status = clStatusOpen
+
+	kvs, err := r.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+		rng, err := fdb.PrefixRange(tuple.Tuple{commitLogKey}.Pack())
+		if err != nil {
+			return nil, err
+		}
+		return tr.GetRange(rng, fdb.RangeOptions{}).GetSliceWithError()
+	})
+	if err != nil {
+		return err
+	}
+
+	// Each shard keys its blocks in increasing order, so the range read
+	// above already returns every shard's blocks in the order that shard
+	// flushed them.
+	for _, kv := range kvs.([]fdb.KeyValue) {
+		records, err := decodeBlock(kv.Value)
+		if err != nil {
+			return err
+		}
+		r.records = append(r.records, records...)
+	}
+
+	return nil
+}
+
+func (r *commitlogReader) Next() ([]byte, error) {
+	if r.status != clStatusOpen {
+		return nil, errors.New("cannot read from commitlog reader that is not open")
+	}
+	if r.idx >= len(r.records) {
+		return nil, io.EOF
+	}
+
+	record := r.records[r.idx]
+	r.idx++
+	return record, nil
+}
+
+func (r *commitlogReader) Close() error {
+	if r.status != clStatusOpen {
+		return errors.New("cannot close commitlog reader that is not open")
+	}
+	r.status = clStatusClosed
+	return nil
+}
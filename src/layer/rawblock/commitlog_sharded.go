@@ -0,0 +1,132 @@
+package rawblock
+
+import (
+	"hash/fnv"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// TruncationToken is an opaque token that can be passed to Commitlog.Truncate
+// to truncate every shard's commitlog up to a specific point. Build one with
+// NewTruncationToken and Advance, fed from the ShardID and ActiveLogs on the
+// ActiveLogsEvent callbacks a retention policy observes via RegisterListener
+// once it knows a shard's blocks up to a given key are no longer needed.
+type TruncationToken struct {
+	// upTo holds the upTo tuple for shard i at index i; a nil entry leaves
+	// that shard untouched.
+	upTo []tuple.Tuple
+}
+
+// NewTruncationToken creates an empty TruncationToken for a Commitlog with
+// numShards shards. A shard that Advance is never called for is left
+// untouched by Truncate.
+func NewTruncationToken(numShards int) TruncationToken {
+	return TruncationToken{upTo: make([]tuple.Tuple, numShards)}
+}
+
+// Advance records that shardID's commitlog can be truncated up to (but not
+// including) upTo, overwriting any point previously recorded for that shard.
+func (t TruncationToken) Advance(shardID int, upTo tuple.Tuple) {
+	t.upTo[shardID] = upTo
+}
+
+// shardedCommitlog fans writes out across NumShards independent commitlog
+// writers, each with its own in-memory batch and flush loop, so that a
+// single process can drive multiple concurrent FDB transactions instead of
+// being bottlenecked on one flusher. Writes for a given routing key always
+// land on the same shard, so per-key ordering is preserved even though
+// unrelated writes flush in parallel.
+type shardedCommitlog struct {
+	shards []*commitlog
+}
+
+// NewCommitlog creates a Commitlog sharded across opts.NumShards
+// independent writers, each keyed by opts.HostID and its shard id.
+func NewCommitlog(db fdb.Database, opts CommitlogOptions) Commitlog {
+	numShards := opts.NumShards
+	if numShards <= 0 {
+		numShards = defaultNumShards
+	}
+
+	shards := make([]*commitlog, 0, numShards)
+	for shardID := 0; shardID < numShards; shardID++ {
+		shards = append(shards, newCommitlogShard(db, opts, opts.HostID, shardID))
+	}
+
+	return &shardedCommitlog{shards: shards}
+}
+
+// shardFor picks the shard a routingKey hashes to. An empty routingKey
+// always routes to shard 0, e.g. for callers that don't care about
+// ordering relative to other writes.
+func (s *shardedCommitlog) shardFor(routingKey []byte) *commitlog {
+	if len(routingKey) == 0 {
+		return s.shards[0]
+	}
+
+	h := fnv.New32a()
+	h.Write(routingKey)
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *shardedCommitlog) Write(routingKey []byte, seq int64, b []byte) error {
+	return s.shardFor(routingKey).Write(seq, b)
+}
+
+func (s *shardedCommitlog) WriteNoSyncWait(routingKey []byte, seq int64, b []byte) (SyncHandle, error) {
+	return s.shardFor(routingKey).WriteNoSyncWait(seq, b)
+}
+
+func (s *shardedCommitlog) Open() error {
+	for _, shard := range s.shards {
+		if err := shard.Open(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedCommitlog) Close() error {
+	var firstErr error
+	for _, shard := range s.shards {
+		if err := shard.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Metrics aggregates per-shard queue metrics: depth sums across shards,
+// wait time reports the worst offender.
+func (s *shardedCommitlog) Metrics() CommitlogMetrics {
+	var agg CommitlogMetrics
+	for _, shard := range s.shards {
+		m := shard.Metrics()
+		agg.QueueDepthBytes += m.QueueDepthBytes
+		if m.QueueWaitTime > agg.QueueWaitTime {
+			agg.QueueWaitTime = m.QueueWaitTime
+		}
+	}
+	return agg
+}
+
+func (s *shardedCommitlog) RegisterListener(fn func(CallbackResult)) {
+	for _, shard := range s.shards {
+		shard.RegisterListener(fn)
+	}
+}
+
+// Truncate truncates every shard's commitlog up to the point recorded in
+// token for that shard.
+func (s *shardedCommitlog) Truncate(token TruncationToken) error {
+	for i, shard := range s.shards {
+		if i >= len(token.upTo) || token.upTo[i] == nil {
+			continue
+		}
+		if err := shard.truncateUpTo(token.upTo[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package rawblock
+
+import "testing"
+
+func TestFlushOutcomeMarkEnqueuedDispatchesWriteEvent(t *testing.T) {
+	var events []EventType
+	f := newFlushOutcome(func(result CallbackResult) {
+		events = append(events, result.EventType)
+	})
+
+	f.markEnqueued()
+
+	if !f.enqueued {
+		t.Fatalf("expected enqueued to be true")
+	}
+	if len(events) != 1 || events[0] != WriteEvent {
+		t.Fatalf("expected a single WriteEvent, got %v", events)
+	}
+}
+
+func TestSyncHandleSeqNum(t *testing.T) {
+	f := newFlushOutcome(nil)
+	h := &syncHandle{seq: 42, outcome: f}
+
+	if got := h.SeqNum(); got != 42 {
+		t.Fatalf("expected SeqNum() 42, got %d", got)
+	}
+
+	go f.notify(nil, ActiveLogsResult{}, nil)
+	if err := h.SyncWait(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
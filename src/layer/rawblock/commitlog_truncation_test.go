@@ -0,0 +1,38 @@
+package rawblock
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+func TestTruncationTokenAdvance(t *testing.T) {
+	token := NewTruncationToken(3)
+
+	token.Advance(1, tuple.Tuple{"commitlog-", "host", 1, int64(5)})
+
+	if token.upTo[0] != nil {
+		t.Fatalf("expected shard 0 untouched, got %v", token.upTo[0])
+	}
+	if !reflect.DeepEqual(token.upTo[1], tuple.Tuple{"commitlog-", "host", 1, int64(5)}) {
+		t.Fatalf("expected shard 1's upTo to be set, got %v", token.upTo[1])
+	}
+	if token.upTo[2] != nil {
+		t.Fatalf("expected shard 2 untouched, got %v", token.upTo[2])
+	}
+}
+
+func TestDispatchStampsShardID(t *testing.T) {
+	c := &commitlog{shardID: 2}
+
+	var got CallbackResult
+	c.RegisterListener(func(result CallbackResult) {
+		got = result
+	})
+	c.dispatch(CallbackResult{EventType: WriteEvent})
+
+	if got.ShardID != 2 {
+		t.Fatalf("expected ShardID 2, got %d", got.ShardID)
+	}
+}